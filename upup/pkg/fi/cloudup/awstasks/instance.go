@@ -23,14 +23,21 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/kops/upup/pkg/fi"
 	"k8s.io/kops/upup/pkg/fi/cloudup/awsup"
 	"k8s.io/kops/upup/pkg/fi/cloudup/terraform"
 	"strings"
+	"time"
 )
 
 const MaxUserDataSize = 16384
 
+// UserDataOverflowThreshold is the default size, in bytes, above which we start gzipping
+// (and potentially spilling to S3) rendered UserData, a little below MaxUserDataSize. Both
+// limits are compared with the raw UserData bytes, before base64 encoding.
+const UserDataOverflowThreshold = 14 * 1024
+
 type Instance struct {
 	ID *string
 
@@ -48,6 +55,91 @@ type Instance struct {
 	SecurityGroups     []*SecurityGroup
 	AssociatePublicIP  *bool
 	IAMInstanceProfile *IAMInstanceProfile
+
+	// SpotPrice, SpotType, ValidUntil, and InstanceInterruptionBehavior cover launching a single
+	// EC2 Spot Instance via RequestSpotInstances. Spot Fleet (RequestSpotFleet) is NOT supported:
+	// a fleet request manages a pool of instances as a unit, which doesn't map onto Instance's
+	// one-task-per-instance model, and fleet requests aren't reflected back through Find the way
+	// a single spot instance request is here. Launching a fleet remains a todo, not a silent gap.
+
+	// SpotPrice is the maximum price to pay for the instance when launching it as a spot
+	// instance. If this is left unset, the Instance is launched as an on-demand instance.
+	SpotPrice *string
+	// SpotType is the spot request type: "one-time" or "persistent". Defaults to "one-time".
+	SpotType *string
+	// ValidUntil is the expiration time for the spot request, in the RFC3339 format used by the EC2 API.
+	ValidUntil *string
+	// InstanceInterruptionBehavior controls what EC2 does with the instance when the spot
+	// request is interrupted: "terminate", "stop", or "hibernate".
+	InstanceInterruptionBehavior *string
+
+	// RootVolumeSize is the size of the root volume, in GB.
+	RootVolumeSize *int64
+	// RootVolumeType is the EBS volume type for the root volume: gp2, gp3, io1, or io2.
+	RootVolumeType *string
+	// RootVolumeIops is the provisioned IOPS for io1/io2/gp3 root volumes.
+	RootVolumeIops *int64
+	// RootVolumeThroughput is the provisioned throughput, in MB/s, for gp3 root volumes.
+	RootVolumeThroughput *int64
+	// RootVolumeEncrypted indicates whether the root volume should be encrypted.
+	RootVolumeEncrypted *bool
+	// RootVolumeKmsKeyID is the KMS key used to encrypt the root volume, if RootVolumeEncrypted is set.
+	RootVolumeKmsKeyID *string
+
+	// MetadataOptions configures the instance metadata service (IMDS).
+	MetadataOptions *InstanceMetadataOptions
+
+	// UserDataOverflow configures what happens when rendered UserData is too large to pass
+	// directly to EC2. If nil, UserData above UserDataOverflowThreshold is gzipped, and UserData
+	// that is still too large after gzip is an error, since there is no bucket to spill it to.
+	UserDataOverflow *UserDataOverflow
+
+	// SourceDestCheck controls whether source/destination checking is enabled on the instance's
+	// primary network interface. Disable this to let the instance act as a NAT or router.
+	SourceDestCheck *bool
+
+	// Timeouts bounds how long we wait for each phase of the Instance lifecycle.
+	Timeouts *InstanceTimeouts
+}
+
+// InstanceTimeouts bounds how long RenderAWS waits for each phase of the Instance lifecycle.
+type InstanceTimeouts struct {
+	// Create is how long to wait for a newly-launched instance to reach the "running" state. For a
+	// spot instance it also bounds, separately, the wait for the spot request to be fulfilled.
+	Create *time.Duration
+	// Update bounds each wait in a stop/modify/start cycle triggered by an InstanceType change:
+	// the wait for the instance to stop and the wait for it to run again are timed separately.
+	Update *time.Duration
+}
+
+const (
+	defaultCreateTimeout = 5 * time.Minute
+	defaultUpdateTimeout = 5 * time.Minute
+)
+
+// UserDataOverflow configures the UserData spillover behavior used when the rendered
+// UserData is too large to embed directly in the RunInstances request.
+type UserDataOverflow struct {
+	// Threshold is the size, in bytes, above which UserData is gzipped (and, if still too
+	// large, uploaded to S3). Defaults to UserDataOverflowThreshold.
+	Threshold *int64
+	// S3Bucket is the bucket overflow UserData is stored in. There is no default: the caller
+	// must set this (typically to the cluster's state store bucket) for overflow to be usable,
+	// since the instance's IAM role also needs a matching s3:GetObject grant, which this task
+	// does not itself add to the role's policy (see S3UserDataStore.GrantReadStatement).
+	S3Bucket *string
+}
+
+// InstanceMetadataOptions controls access to the EC2 instance metadata service.
+type InstanceMetadataOptions struct {
+	// HttpTokens is "optional" (IMDSv1 and IMDSv2) or "required" (IMDSv2 only).
+	HttpTokens *string
+	// HttpPutResponseHopLimit bounds the number of network hops the metadata token can travel.
+	HttpPutResponseHopLimit *int64
+	// HttpEndpoint is "enabled" or "disabled".
+	HttpEndpoint *string
+	// InstanceMetadataTags is "enabled" or "disabled", and controls whether instance tags are exposed via IMDS.
+	InstanceMetadataTags *string
 }
 
 var _ fi.CompareWithID = &Instance{}
@@ -65,7 +157,7 @@ func (e *Instance) Find(c *fi.Context) (*Instance, error) {
 		Filters: filters,
 	}
 
-	response, err := cloud.EC2().DescribeInstances(request)
+	response, err := awsup.ThrottledEC2(cloud).DescribeInstances(request)
 	if err != nil {
 		return nil, fmt.Errorf("error listing instances: %v", err)
 	}
@@ -107,7 +199,7 @@ func (e *Instance) Find(c *fi.Context) (*Instance, error) {
 		request := &ec2.DescribeInstanceAttributeInput{}
 		request.InstanceId = i.InstanceId
 		request.Attribute = aws.String("userData")
-		response, err := cloud.EC2().DescribeInstanceAttribute(request)
+		response, err := awsup.ThrottledEC2(cloud).DescribeInstanceAttribute(request)
 		if err != nil {
 			return nil, fmt.Errorf("error querying EC2 for user metadata for instance %q: %v", *i.InstanceId, err)
 		}
@@ -139,10 +231,68 @@ func (e *Instance) Find(c *fi.Context) (*Instance, error) {
 	}
 	actual.AssociatePublicIP = &associatePublicIpAddress
 
+	for _, ni := range i.NetworkInterfaces {
+		if ni.SourceDestCheck != nil {
+			actual.SourceDestCheck = ni.SourceDestCheck
+			break
+		}
+	}
+
 	if i.IamInstanceProfile != nil {
 		actual.IAMInstanceProfile = &IAMInstanceProfile{Name: nameFromIAMARN(i.IamInstanceProfile.Arn)}
 	}
 
+	if i.RootDeviceName != nil {
+		for _, bdm := range i.BlockDeviceMappings {
+			if aws.StringValue(bdm.DeviceName) != *i.RootDeviceName || bdm.Ebs == nil {
+				continue
+			}
+
+			volume, err := awsup.ThrottledEC2(cloud).DescribeVolumes(&ec2.DescribeVolumesInput{
+				VolumeIds: []*string{bdm.Ebs.VolumeId},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error describing root volume %q: %v", aws.StringValue(bdm.Ebs.VolumeId), err)
+			}
+			if volume == nil || len(volume.Volumes) == 0 {
+				break
+			}
+
+			v := volume.Volumes[0]
+			actual.RootVolumeSize = v.Size
+			actual.RootVolumeType = v.VolumeType
+			actual.RootVolumeIops = v.Iops
+			actual.RootVolumeThroughput = v.Throughput
+			actual.RootVolumeEncrypted = v.Encrypted
+			actual.RootVolumeKmsKeyID = v.KmsKeyId
+			break
+		}
+	}
+
+	if i.MetadataOptions != nil {
+		actual.MetadataOptions = &InstanceMetadataOptions{
+			HttpTokens:              i.MetadataOptions.HttpTokens,
+			HttpPutResponseHopLimit: i.MetadataOptions.HttpPutResponseHopLimit,
+			HttpEndpoint:            i.MetadataOptions.HttpEndpoint,
+			InstanceMetadataTags:    i.MetadataOptions.InstanceMetadataTags,
+		}
+	}
+
+	if i.SpotInstanceRequestId != nil {
+		spotRequest, err := findSpotInstanceRequest(cloud, *i.SpotInstanceRequestId)
+		if err != nil {
+			return nil, err
+		}
+		if spotRequest != nil {
+			actual.SpotPrice = spotRequest.SpotPrice
+			actual.SpotType = spotRequest.Type
+			actual.InstanceInterruptionBehavior = spotRequest.InstanceInterruptionBehavior
+			if spotRequest.ValidUntil != nil {
+				actual.ValidUntil = aws.String(spotRequest.ValidUntil.Format(time.RFC3339))
+			}
+		}
+	}
+
 	actual.Tags = mapEC2TagsToMap(i.Tags)
 
 	e.ID = actual.ID
@@ -191,6 +341,50 @@ func (_ *Instance) CheckChanges(a, e, changes *Instance) error {
 		if e.Name == nil {
 			return fi.RequiredField("Name")
 		}
+		if changes.ImageID != nil {
+			return fi.FieldIsImmutable(e.ImageID, a.ImageID, field.NewPath("ImageID"))
+		}
+		if changes.Subnet != nil {
+			return fi.FieldIsImmutable(e.Subnet, a.Subnet, field.NewPath("Subnet"))
+		}
+		if changes.SSHKey != nil {
+			return fi.FieldIsImmutable(e.SSHKey, a.SSHKey, field.NewPath("SSHKey"))
+		}
+		// The root volume is only ever configured via the BlockDeviceMapping passed to
+		// RunInstances; changing it on a running instance would mean resizing/retyping the
+		// actual EBS volume out from under the task, which we don't attempt here.
+		if changes.RootVolumeSize != nil {
+			return fi.FieldIsImmutable(e.RootVolumeSize, a.RootVolumeSize, field.NewPath("RootVolumeSize"))
+		}
+		if changes.RootVolumeType != nil {
+			return fi.FieldIsImmutable(e.RootVolumeType, a.RootVolumeType, field.NewPath("RootVolumeType"))
+		}
+		if changes.RootVolumeIops != nil {
+			return fi.FieldIsImmutable(e.RootVolumeIops, a.RootVolumeIops, field.NewPath("RootVolumeIops"))
+		}
+		if changes.RootVolumeThroughput != nil {
+			return fi.FieldIsImmutable(e.RootVolumeThroughput, a.RootVolumeThroughput, field.NewPath("RootVolumeThroughput"))
+		}
+		if changes.RootVolumeEncrypted != nil {
+			return fi.FieldIsImmutable(e.RootVolumeEncrypted, a.RootVolumeEncrypted, field.NewPath("RootVolumeEncrypted"))
+		}
+		if changes.RootVolumeKmsKeyID != nil {
+			return fi.FieldIsImmutable(e.RootVolumeKmsKeyID, a.RootVolumeKmsKeyID, field.NewPath("RootVolumeKmsKeyID"))
+		}
+		// Spot-vs-on-demand is a property of how the instance was launched; there's no API to
+		// flip a running instance between the two, so treat all of these as immutable too.
+		if changes.SpotPrice != nil {
+			return fi.FieldIsImmutable(e.SpotPrice, a.SpotPrice, field.NewPath("SpotPrice"))
+		}
+		if changes.SpotType != nil {
+			return fi.FieldIsImmutable(e.SpotType, a.SpotType, field.NewPath("SpotType"))
+		}
+		if changes.ValidUntil != nil {
+			return fi.FieldIsImmutable(e.ValidUntil, a.ValidUntil, field.NewPath("ValidUntil"))
+		}
+		if changes.InstanceInterruptionBehavior != nil {
+			return fi.FieldIsImmutable(e.InstanceInterruptionBehavior, a.InstanceInterruptionBehavior, field.NewPath("InstanceInterruptionBehavior"))
+		}
 	}
 	return nil
 }
@@ -232,7 +426,6 @@ func (_ *Instance) RenderAWS(t *awsup.AWSAPITarget, a, e, changes *Instance) err
 		}
 
 		// Build up the actual block device mappings
-		// TODO: Support RootVolumeType & RootVolumeSize (see launchconfiguration)
 		blockDeviceMappings, err := buildEphemeralDevices(e.InstanceType)
 		if err != nil {
 			return err
@@ -245,18 +438,56 @@ func (_ *Instance) RenderAWS(t *awsup.AWSAPITarget, a, e, changes *Instance) err
 			}
 		}
 
+		if e.RootVolumeSize != nil || e.RootVolumeType != nil || e.RootVolumeIops != nil || e.RootVolumeThroughput != nil || e.RootVolumeEncrypted != nil {
+			rootDeviceName := image.RootDeviceName
+			if rootDeviceName == nil {
+				return fmt.Errorf("image %q did not have a RootDeviceName", *image.ImageId)
+			}
+
+			ebs := &ec2.EbsBlockDevice{
+				VolumeSize:          e.RootVolumeSize,
+				VolumeType:          e.RootVolumeType,
+				Iops:                e.RootVolumeIops,
+				Throughput:          e.RootVolumeThroughput,
+				Encrypted:           e.RootVolumeEncrypted,
+				KmsKeyId:            e.RootVolumeKmsKeyID,
+				DeleteOnTermination: aws.Bool(true),
+			}
+			request.BlockDeviceMappings = append(request.BlockDeviceMappings, &ec2.BlockDeviceMapping{
+				DeviceName: rootDeviceName,
+				Ebs:        ebs,
+			})
+		}
+
 		if e.UserData != nil {
 			d, err := fi.ResourceAsBytes(e.UserData)
 			if err != nil {
 				return fmt.Errorf("error rendering Instance UserData: %v", err)
 			}
+
+			threshold := int64(UserDataOverflowThreshold)
+			if e.UserDataOverflow != nil && e.UserDataOverflow.Threshold != nil {
+				threshold = *e.UserDataOverflow.Threshold
+			}
+
+			// Anything too large for EC2 is always gzipped, even with a Threshold above
+			// MaxUserDataSize, because the S3 bootstrap script gunzips what it fetches.
+			if int64(len(d)) > threshold || len(d) > MaxUserDataSize {
+				gzipped, err := fi.GzipBytes(d)
+				if err != nil {
+					return fmt.Errorf("error while gzipping UserData: %v", err)
+				}
+				d = gzipped
+			}
+
+			if len(d) > MaxUserDataSize {
+				d, err = overflowUserDataToS3(t.Cloud, e, d)
+				if err != nil {
+					return err
+				}
+			}
+
 			if len(d) > MaxUserDataSize {
-				// TODO: Re-enable gzip?
-				// But it exposes some bugs in the AWS console, so if we can avoid it, we should
-				//d, err = fi.GzipBytes(d)
-				//if err != nil {
-				//	return fmt.Errorf("error while gzipping UserData: %v", err)
-				//}
 				return fmt.Errorf("Instance UserData was too large (%d bytes)", len(d))
 			}
 			request.UserData = aws.String(base64.StdEncoding.EncodeToString(d))
@@ -268,17 +499,578 @@ func (_ *Instance) RenderAWS(t *awsup.AWSAPITarget, a, e, changes *Instance) err
 			}
 		}
 
-		response, err := t.Cloud.EC2().RunInstances(request)
-		if err != nil {
-			return fmt.Errorf("error creating Instance: %v", err)
+		if e.MetadataOptions != nil {
+			request.MetadataOptions = &ec2.InstanceMetadataOptionsRequest{
+				HttpTokens:              e.MetadataOptions.HttpTokens,
+				HttpPutResponseHopLimit: e.MetadataOptions.HttpPutResponseHopLimit,
+				HttpEndpoint:            e.MetadataOptions.HttpEndpoint,
+				InstanceMetadataTags:    e.MetadataOptions.InstanceMetadataTags,
+			}
+		}
+
+		if e.SpotPrice != nil {
+			instanceID, err := runSpotInstance(t.Cloud, e, request)
+			if err != nil {
+				return err
+			}
+			e.ID = instanceID
+		} else {
+			response, err := awsup.ThrottledEC2(t.Cloud).RunInstances(request)
+			if err != nil {
+				return fmt.Errorf("error creating Instance: %v", err)
+			}
+
+			e.ID = response.Instances[0].InstanceId
 		}
 
-		e.ID = response.Instances[0].InstanceId
+		if err := waitForState(t.Cloud, *e.ID, instanceTimeout(e.Timeouts, false), ec2.InstanceStateNameRunning); err != nil {
+			return err
+		}
+
+		if e.SourceDestCheck != nil && !*e.SourceDestCheck {
+			if err := modifySourceDestCheck(t.Cloud, *e.ID, e.SourceDestCheck); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := applyInstanceChanges(t, a, e, changes); err != nil {
+			return err
+		}
 	}
 
 	return t.AddAWSTags(*e.ID, e.Tags)
 }
 
+// instanceTimeout returns the configured create/update timeout, falling back to the package defaults.
+func instanceTimeout(timeouts *InstanceTimeouts, isUpdate bool) time.Duration {
+	if timeouts != nil {
+		if isUpdate && timeouts.Update != nil {
+			return *timeouts.Update
+		}
+		if !isUpdate && timeouts.Create != nil {
+			return *timeouts.Create
+		}
+	}
+	if isUpdate {
+		return defaultUpdateTimeout
+	}
+	return defaultCreateTimeout
+}
+
+// waitForState polls DescribeInstancesPages until the instance reaches one of the wanted states,
+// backing off between attempts, or returns an error once timeout elapses.
+func waitForState(cloud awsup.AWSCloud, instanceID string, timeout time.Duration, wantedStates ...string) error {
+	deadline := time.Now().Add(timeout)
+	delay := 2 * time.Second
+
+	for {
+		request := &ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		}
+
+		var state string
+		err := awsup.ThrottledEC2(cloud).DescribeInstancesPages(request, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					if aws.StringValue(instance.InstanceId) == instanceID && instance.State != nil {
+						state = aws.StringValue(instance.State.Name)
+					}
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("error describing instance %q while waiting for state: %v", instanceID, err)
+		}
+
+		for _, wanted := range wantedStates {
+			if state == wanted {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for instance %q to reach state %v (last seen: %q)", instanceID, wantedStates, state)
+		}
+
+		glog.V(2).Infof("waiting for instance %q to reach state %v (currently %q)", instanceID, wantedStates, state)
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+func modifySourceDestCheck(cloud awsup.AWSCloud, instanceID string, value *bool) error {
+	glog.V(2).Infof("Modifying SourceDestCheck on instance %q to %v", instanceID, aws.BoolValue(value))
+	_, err := awsup.ThrottledEC2(cloud).ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId:      aws.String(instanceID),
+		SourceDestCheck: &ec2.AttributeBooleanValue{Value: value},
+	})
+	if err != nil {
+		return fmt.Errorf("error modifying SourceDestCheck on instance %q: %v", instanceID, err)
+	}
+	return nil
+}
+
+// applyInstanceChanges reconciles mutable attributes on an existing Instance: tags, security
+// groups, the IAM instance profile association, source/destination checking, metadata options,
+// and - when necessary - the instance type (which requires a stop/modify/start cycle).
+func applyInstanceChanges(t *awsup.AWSAPITarget, a, e, changes *Instance) error {
+	cloud := t.Cloud
+
+	if changes.SourceDestCheck != nil {
+		if err := modifySourceDestCheck(cloud, *e.ID, e.SourceDestCheck); err != nil {
+			return err
+		}
+	}
+
+	if changes.MetadataOptions != nil {
+		glog.V(2).Infof("Modifying instance metadata options for %q", *e.ID)
+		_, err := awsup.ThrottledEC2(cloud).ModifyInstanceMetadataOptions(&ec2.ModifyInstanceMetadataOptionsInput{
+			InstanceId:              e.ID,
+			HttpTokens:              e.MetadataOptions.HttpTokens,
+			HttpPutResponseHopLimit: e.MetadataOptions.HttpPutResponseHopLimit,
+			HttpEndpoint:            e.MetadataOptions.HttpEndpoint,
+			InstanceMetadataTags:    e.MetadataOptions.InstanceMetadataTags,
+		})
+		if err != nil {
+			return fmt.Errorf("error modifying instance metadata options for %q: %v", *e.ID, err)
+		}
+	}
+
+	if changes.SecurityGroups != nil {
+		groupIDs := []*string{}
+		for _, sg := range e.SecurityGroups {
+			groupIDs = append(groupIDs, sg.ID)
+		}
+		glog.V(2).Infof("Modifying security groups on instance %q", *e.ID)
+		_, err := awsup.ThrottledEC2(cloud).ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+			InstanceId: e.ID,
+			Groups:     groupIDs,
+		})
+		if err != nil {
+			return fmt.Errorf("error modifying security groups on instance %q: %v", *e.ID, err)
+		}
+	}
+
+	if changes.IAMInstanceProfile != nil {
+		if err := replaceIAMInstanceProfile(cloud, *e.ID, e.IAMInstanceProfile); err != nil {
+			return err
+		}
+	}
+
+	if changes.InstanceType != nil {
+		if err := modifyInstanceType(t, e); err != nil {
+			return err
+		}
+	}
+
+	if changes.Tags != nil {
+		if err := reconcileTags(cloud, *e.ID, a.Tags, e.Tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// modifyInstanceType changes the instance type of a stopped-or-running instance, stopping it
+// first (and starting it back up afterwards) if it isn't already stopped.
+func modifyInstanceType(t *awsup.AWSAPITarget, e *Instance) error {
+	cloud := t.Cloud
+
+	described, descErr := awsup.ThrottledEC2(cloud).DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{e.ID}})
+	if descErr != nil {
+		return fmt.Errorf("error describing instance %q: %v", *e.ID, descErr)
+	}
+	wasStopped := false
+	for _, reservation := range described.Reservations {
+		for _, instance := range reservation.Instances {
+			wasStopped = instance.State != nil && aws.StringValue(instance.State.Name) == ec2.InstanceStateNameStopped
+		}
+	}
+
+	glog.V(2).Infof("Stopping instance %q to change InstanceType", *e.ID)
+	_, err := awsup.ThrottledEC2(cloud).StopInstances(&ec2.StopInstancesInput{InstanceIds: []*string{e.ID}})
+	if err != nil {
+		return fmt.Errorf("error stopping instance %q: %v", *e.ID, err)
+	}
+	if err := waitForState(cloud, *e.ID, instanceTimeout(e.Timeouts, true), ec2.InstanceStateNameStopped); err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("Modifying InstanceType on instance %q to %q", *e.ID, aws.StringValue(e.InstanceType))
+	_, err = awsup.ThrottledEC2(cloud).ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId:   e.ID,
+		InstanceType: &ec2.AttributeValue{Value: e.InstanceType},
+	})
+	if err != nil {
+		return fmt.Errorf("error modifying InstanceType on instance %q: %v", *e.ID, err)
+	}
+	if wasStopped {
+		return nil
+	}
+
+	glog.V(2).Infof("Starting instance %q", *e.ID)
+	_, err = awsup.ThrottledEC2(cloud).StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{e.ID}})
+	if err != nil {
+		return fmt.Errorf("error starting instance %q: %v", *e.ID, err)
+	}
+	return waitForState(cloud, *e.ID, instanceTimeout(e.Timeouts, true), ec2.InstanceStateNameRunning)
+}
+
+// replaceIAMInstanceProfile associates the given IAM instance profile with the instance,
+// replacing any existing association.
+func replaceIAMInstanceProfile(cloud awsup.AWSCloud, instanceID string, profile *IAMInstanceProfile) error {
+	associations, err := awsup.ThrottledEC2(cloud).DescribeIamInstanceProfileAssociations(&ec2.DescribeIamInstanceProfileAssociationsInput{
+		Filters: []*ec2.Filter{
+			awsup.NewEC2Filter("instance-id", instanceID),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing IAM instance profile associations for %q: %v", instanceID, err)
+	}
+
+	spec := &ec2.IamInstanceProfileSpecification{Name: profile.Name}
+
+	var activeAssociationID *string
+	for _, assoc := range associations.IamInstanceProfileAssociations {
+		if aws.StringValue(assoc.State) == ec2.IamInstanceProfileAssociationStateAssociated {
+			activeAssociationID = assoc.AssociationId
+			break
+		}
+	}
+
+	if activeAssociationID == nil {
+		glog.V(2).Infof("Associating IAM instance profile %q with instance %q", aws.StringValue(profile.Name), instanceID)
+		_, err := awsup.ThrottledEC2(cloud).AssociateIamInstanceProfile(&ec2.AssociateIamInstanceProfileInput{
+			InstanceId:         aws.String(instanceID),
+			IamInstanceProfile: spec,
+		})
+		if err != nil {
+			return fmt.Errorf("error associating IAM instance profile %q with instance %q: %v", aws.StringValue(profile.Name), instanceID, err)
+		}
+		return nil
+	}
+
+	glog.V(2).Infof("Replacing IAM instance profile association %q on instance %q with %q", aws.StringValue(activeAssociationID), instanceID, aws.StringValue(profile.Name))
+	_, err = awsup.ThrottledEC2(cloud).ReplaceIamInstanceProfileAssociation(&ec2.ReplaceIamInstanceProfileAssociationInput{
+		AssociationId:      activeAssociationID,
+		IamInstanceProfile: spec,
+	})
+	if err != nil {
+		return fmt.Errorf("error replacing IAM instance profile association on instance %q: %v", instanceID, err)
+	}
+	return nil
+}
+
+// reconcileTags brings the instance's tags in line with the expected set, issuing CreateTags
+// for additions/changes and DeleteTags for removals.
+func reconcileTags(cloud awsup.AWSCloud, instanceID string, actual, expected map[string]string) error {
+	toCreate := map[string]string{}
+	for k, v := range expected {
+		if actual[k] != v {
+			toCreate[k] = v
+		}
+	}
+	if len(toCreate) != 0 {
+		tags := []*ec2.Tag{}
+		for k, v := range toCreate {
+			tags = append(tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		glog.V(2).Infof("Creating/updating tags on instance %q: %v", instanceID, toCreate)
+		_, err := awsup.ThrottledEC2(cloud).CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{aws.String(instanceID)},
+			Tags:      tags,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating tags on instance %q: %v", instanceID, err)
+		}
+	}
+
+	toDelete := []*ec2.Tag{}
+	for k := range actual {
+		if _, found := expected[k]; !found {
+			toDelete = append(toDelete, &ec2.Tag{Key: aws.String(k)})
+		}
+	}
+	if len(toDelete) != 0 {
+		glog.V(2).Infof("Deleting tags on instance %q: %v", instanceID, toDelete)
+		_, err := awsup.ThrottledEC2(cloud).DeleteTags(&ec2.DeleteTagsInput{
+			Resources: []*string{aws.String(instanceID)},
+			Tags:      toDelete,
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting tags on instance %q: %v", instanceID, err)
+		}
+	}
+
+	return nil
+}
+
+// runSpotInstance requests a spot instance matching runRequest, waits for it to be fulfilled,
+// and returns the InstanceId of the resulting instance.
+func runSpotInstance(cloud awsup.AWSCloud, e *Instance, runRequest *ec2.RunInstancesInput) (*string, error) {
+	spotType := aws.StringValue(e.SpotType)
+	if spotType == "" {
+		spotType = ec2.SpotInstanceTypeOneTime
+	}
+
+	launchSpec := &ec2.RequestSpotLaunchSpecification{
+		ImageId:             runRequest.ImageId,
+		InstanceType:        runRequest.InstanceType,
+		KeyName:             runRequest.KeyName,
+		NetworkInterfaces:   runRequest.NetworkInterfaces,
+		BlockDeviceMappings: runRequest.BlockDeviceMappings,
+		UserData:            runRequest.UserData,
+	}
+	if runRequest.IamInstanceProfile != nil {
+		launchSpec.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{
+			Name: runRequest.IamInstanceProfile.Name,
+			Arn:  runRequest.IamInstanceProfile.Arn,
+		}
+	}
+	if runRequest.MetadataOptions != nil {
+		// RequestSpotLaunchSpecification has its own metadata options type, so a RunInstancesInput's
+		// options are copied across field by field. InstanceMetadataTags is not copied, so it has
+		// no effect on spot instances.
+		launchSpec.MetadataOptions = &ec2.SpotInstanceMetadataOptions{
+			HttpTokens:              runRequest.MetadataOptions.HttpTokens,
+			HttpPutResponseHopLimit: runRequest.MetadataOptions.HttpPutResponseHopLimit,
+			HttpEndpoint:            runRequest.MetadataOptions.HttpEndpoint,
+		}
+	}
+
+	request := &ec2.RequestSpotInstancesInput{
+		SpotPrice:                    e.SpotPrice,
+		InstanceCount:                aws.Int64(1),
+		Type:                         aws.String(spotType),
+		ValidUntil:                   nil,
+		InstanceInterruptionBehavior: e.InstanceInterruptionBehavior,
+		LaunchSpecification:          launchSpec,
+	}
+	if e.ValidUntil != nil {
+		validUntil, err := time.Parse(time.RFC3339, *e.ValidUntil)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ValidUntil %q: %v", *e.ValidUntil, err)
+		}
+		request.ValidUntil = &validUntil
+	}
+
+	glog.V(2).Infof("Requesting spot instance with price %q", *e.SpotPrice)
+	response, err := awsup.ThrottledEC2(cloud).RequestSpotInstances(request)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting spot instance: %v", err)
+	}
+	if len(response.SpotInstanceRequests) != 1 {
+		return nil, fmt.Errorf("expected exactly one spot instance request, got %d", len(response.SpotInstanceRequests))
+	}
+	spotRequestID := response.SpotInstanceRequests[0].SpotInstanceRequestId
+
+	spotRequest, err := waitSpotInstanceRequestFulfilled(cloud, *spotRequestID, instanceTimeout(e.Timeouts, false))
+	if err != nil {
+		return nil, err
+	}
+	if spotRequest.InstanceId == nil {
+		return nil, fmt.Errorf("spot instance request %q was fulfilled but has no InstanceId", *spotRequestID)
+	}
+
+	return spotRequest.InstanceId, nil
+}
+
+// waitSpotInstanceRequestFulfilled polls a spot instance request until it reaches the
+// "fulfilled" state, or returns an error if it reaches a terminal failure state or the
+// timeout elapses. On timeout it cancels the request so we don't leave an open spot request
+// (still eligible for fulfillment, and still billable once it is) behind.
+func waitSpotInstanceRequestFulfilled(cloud awsup.AWSCloud, spotRequestID string, timeout time.Duration) (*ec2.SpotInstanceRequest, error) {
+	deadline := time.Now().Add(timeout)
+	delay := 10 * time.Second
+
+	for {
+		spotRequest, err := findSpotInstanceRequest(cloud, spotRequestID)
+		if err != nil {
+			return nil, err
+		}
+		if spotRequest == nil {
+			return nil, fmt.Errorf("spot instance request %q not found", spotRequestID)
+		}
+
+		state := aws.StringValue(spotRequest.State)
+		switch state {
+		case ec2.SpotInstanceStateActive, ec2.SpotInstanceStateClosed:
+			return spotRequest, nil
+		case ec2.SpotInstanceStateFailed, ec2.SpotInstanceStateCancelled:
+			return nil, fmt.Errorf("spot instance request %q entered state %q: %s", spotRequestID, state, aws.StringValue(spotRequest.Status.Message))
+		}
+
+		if time.Now().After(deadline) {
+			cancelSpotInstanceRequest(cloud, spotRequestID)
+			return nil, fmt.Errorf("timed out waiting for spot instance request %q to be fulfilled (last seen state: %q)", spotRequestID, state)
+		}
+
+		glog.V(2).Infof("waiting for spot instance request %q to be fulfilled (state=%q)", spotRequestID, state)
+		time.Sleep(delay)
+	}
+}
+
+// cancelSpotInstanceRequest best-effort cancels a spot instance request that we gave up waiting
+// on, logging (rather than returning) any error since the caller is already failing.
+func cancelSpotInstanceRequest(cloud awsup.AWSCloud, spotRequestID string) {
+	_, err := awsup.ThrottledEC2(cloud).CancelSpotInstanceRequests(&ec2.CancelSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{aws.String(spotRequestID)},
+	})
+	if err != nil {
+		glog.Warningf("error cancelling spot instance request %q after timeout: %v", spotRequestID, err)
+	}
+}
+
+// overflowUserDataToS3 uploads UserData that is still too large to pass to EC2 directly to the
+// configured S3 bucket, returning a small bootstrap script that downloads and execs it.
+//
+// This only handles the S3 side: e.IAMInstanceProfile's role must separately be granted the
+// s3:GetObject statement returned by store.GrantReadStatement, or the instance will fail to
+// fetch its own UserData on boot. That grant belongs in the instance-profile policy builder,
+// not here, since this task has no access to the role's policy document.
+func overflowUserDataToS3(cloud awsup.AWSCloud, e *Instance, data []byte) ([]byte, error) {
+	if e.UserDataOverflow == nil || e.UserDataOverflow.S3Bucket == nil {
+		return nil, fmt.Errorf("UserData for %q is too large even after compression, and no UserDataOverflow.S3Bucket was configured to spill it to", aws.StringValue(e.Name))
+	}
+
+	store := awsup.NewS3UserDataStore(cloud, *e.UserDataOverflow.S3Bucket, "instances")
+	key, err := store.Put(aws.StringValue(e.Name), data)
+	if err != nil {
+		return nil, err
+	}
+
+	glog.V(2).Infof("instance %q needs read access to s3://%s/%s; ensure its IAM role has %v", aws.StringValue(e.Name), *e.UserDataOverflow.S3Bucket, key, store.GrantReadStatement(key))
+
+	return []byte(store.BootstrapScript(key)), nil
+}
+
+func findSpotInstanceRequest(cloud awsup.AWSCloud, spotRequestID string) (*ec2.SpotInstanceRequest, error) {
+	request := &ec2.DescribeSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{aws.String(spotRequestID)},
+	}
+	response, err := awsup.ThrottledEC2(cloud).DescribeSpotInstanceRequests(request)
+	if err != nil {
+		return nil, fmt.Errorf("error describing spot instance request %q: %v", spotRequestID, err)
+	}
+	if len(response.SpotInstanceRequests) == 0 {
+		return nil, nil
+	}
+	return response.SpotInstanceRequests[0], nil
+}
+
 func (e *Instance) TerraformLink() *terraform.Literal {
+	if e.SpotPrice != nil {
+		return terraform.LiteralSelfLink("aws_spot_instance_request", *e.Name)
+	}
 	return terraform.LiteralSelfLink("aws_instance", *e.Name)
 }
+
+// terraformRootBlockDevice mirrors the root_block_device block of the aws_instance /
+// aws_spot_instance_request resource.
+type terraformRootBlockDevice struct {
+	VolumeSize *int64  `json:"volume_size,omitempty"`
+	VolumeType *string `json:"volume_type,omitempty"`
+	Iops       *int64  `json:"iops,omitempty"`
+	Throughput *int64  `json:"throughput,omitempty"`
+	Encrypted  *bool   `json:"encrypted,omitempty"`
+	KmsKeyID   *string `json:"kms_key_id,omitempty"`
+}
+
+// terraformMetadataOptions mirrors the metadata_options block of the aws_instance /
+// aws_spot_instance_request resource.
+type terraformMetadataOptions struct {
+	HTTPTokens              *string `json:"http_tokens,omitempty"`
+	HTTPPutResponseHopLimit *int64  `json:"http_put_response_hop_limit,omitempty"`
+	HTTPEndpoint            *string `json:"http_endpoint,omitempty"`
+	InstanceMetadataTags    *string `json:"instance_metadata_tags,omitempty"`
+}
+
+// terraformInstance is the common shape shared by the aws_instance and
+// aws_spot_instance_request resources; the spot-only fields are only populated when
+// e.SpotPrice is set.
+type terraformInstance struct {
+	AMI                      *string                   `json:"ami,omitempty"`
+	InstanceType             *string                   `json:"instance_type,omitempty"`
+	KeyName                  *terraform.Literal        `json:"key_name,omitempty"`
+	SubnetID                 *terraform.Literal        `json:"subnet_id,omitempty"`
+	VPCSecurityGroupIDs      []*terraform.Literal      `json:"vpc_security_group_ids,omitempty"`
+	AssociatePublicIPAddress *bool                     `json:"associate_public_ip_address,omitempty"`
+	IAMInstanceProfile       *terraform.Literal        `json:"iam_instance_profile,omitempty"`
+	SourceDestCheck          *bool                     `json:"source_dest_check,omitempty"`
+	UserData                 *terraform.Literal        `json:"user_data,omitempty"`
+	RootBlockDevice          *terraformRootBlockDevice `json:"root_block_device,omitempty"`
+	MetadataOptions          *terraformMetadataOptions `json:"metadata_options,omitempty"`
+	Tags                     map[string]string         `json:"tags,omitempty"`
+
+	SpotPrice                    *string `json:"spot_price,omitempty"`
+	SpotType                     *string `json:"spot_type,omitempty"`
+	WaitForFulfillment           *bool   `json:"wait_for_fulfillment,omitempty"`
+	ValidUntil                   *string `json:"valid_until,omitempty"`
+	InstanceInterruptionBehavior *string `json:"instance_interruption_behavior,omitempty"`
+}
+
+func (_ *Instance) RenderTerraform(t *terraform.TerraformTarget, a, e, changes *Instance) error {
+	tf := &terraformInstance{
+		AMI:                      e.ImageID,
+		InstanceType:             e.InstanceType,
+		AssociatePublicIPAddress: e.AssociatePublicIP,
+		SourceDestCheck:          e.SourceDestCheck,
+		Tags:                     e.Tags,
+	}
+
+	if e.SSHKey != nil {
+		tf.KeyName = e.SSHKey.TerraformLink()
+	}
+	if e.Subnet != nil {
+		tf.SubnetID = e.Subnet.TerraformLink()
+	}
+	for _, sg := range e.SecurityGroups {
+		tf.VPCSecurityGroupIDs = append(tf.VPCSecurityGroupIDs, sg.TerraformLink())
+	}
+	if e.IAMInstanceProfile != nil {
+		tf.IAMInstanceProfile = e.IAMInstanceProfile.TerraformLink()
+	}
+
+	if e.UserData != nil {
+		userData, err := t.AddFileResource("aws_instance", *e.Name, "user_data", e.UserData, false)
+		if err != nil {
+			return fmt.Errorf("error rendering UserData: %v", err)
+		}
+		tf.UserData = userData
+	}
+
+	if e.RootVolumeSize != nil || e.RootVolumeType != nil || e.RootVolumeIops != nil || e.RootVolumeThroughput != nil || e.RootVolumeEncrypted != nil || e.RootVolumeKmsKeyID != nil {
+		tf.RootBlockDevice = &terraformRootBlockDevice{
+			VolumeSize: e.RootVolumeSize,
+			VolumeType: e.RootVolumeType,
+			Iops:       e.RootVolumeIops,
+			Throughput: e.RootVolumeThroughput,
+			Encrypted:  e.RootVolumeEncrypted,
+			KmsKeyID:   e.RootVolumeKmsKeyID,
+		}
+	}
+
+	if e.MetadataOptions != nil {
+		tf.MetadataOptions = &terraformMetadataOptions{
+			HTTPTokens:              e.MetadataOptions.HttpTokens,
+			HTTPPutResponseHopLimit: e.MetadataOptions.HttpPutResponseHopLimit,
+			HTTPEndpoint:            e.MetadataOptions.HttpEndpoint,
+			InstanceMetadataTags:    e.MetadataOptions.InstanceMetadataTags,
+		}
+	}
+
+	if e.SpotPrice != nil {
+		tf.SpotPrice = e.SpotPrice
+		tf.SpotType = e.SpotType
+		tf.WaitForFulfillment = aws.Bool(false)
+		tf.ValidUntil = e.ValidUntil
+		tf.InstanceInterruptionBehavior = e.InstanceInterruptionBehavior
+		return t.RenderResource("aws_spot_instance_request", *e.Name, tf)
+	}
+
+	return t.RenderResource("aws_instance", *e.Name, tf)
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsup
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+)
+
+// throttleErrorCodes are the EC2 error codes that indicate we should back off and retry,
+// rather than propagating the error immediately.
+var throttleErrorCodes = map[string]bool{
+	"RequestLimitExceeded":        true,
+	"Throttling":                  true,
+	"Client.RequestLimitExceeded": true,
+}
+
+const (
+	throttleMinDelay   = 500 * time.Millisecond
+	throttleMaxDelay   = 20 * time.Second
+	throttleMaxRetries = 8
+
+	// describeRequestsPerSecond and mutatingRequestsPerSecond are conservative steady-state
+	// rates chosen to stay well under the EC2 per-account request limits even when many
+	// awstasks are reconciling concurrently.
+	describeRequestsPerSecond = 20
+	mutatingRequestsPerSecond = 5
+)
+
+// throttledEC2API wraps an ec2iface.EC2API with a per-API-family rate limiter and exponential
+// backoff with jitter on throttling errors.
+//
+// There is deliberately no result cache here: awstasks.Instance's waitForState poll loop issues
+// the same DescribeInstances request on every iteration expecting a fresh answer each time, and
+// a cache keyed on request content would serve it the same stale snapshot until timeout.
+//
+// Only the calls that awstasks.Instance actually issues are overridden below; everything else
+// falls through to the embedded client unwrapped.
+type throttledEC2API struct {
+	ec2iface.EC2API
+
+	describeLimiter *rate.Limiter
+	mutatingLimiter *rate.Limiter
+}
+
+// newThrottledEC2API wraps the given EC2 client with rate limiting and retry/backoff on
+// throttling errors.
+func newThrottledEC2API(inner ec2iface.EC2API) *throttledEC2API {
+	return &throttledEC2API{
+		EC2API:          inner,
+		describeLimiter: rate.NewLimiter(rate.Limit(describeRequestsPerSecond), describeRequestsPerSecond),
+		mutatingLimiter: rate.NewLimiter(rate.Limit(mutatingRequestsPerSecond), mutatingRequestsPerSecond),
+	}
+}
+
+// throttledClients keys a throttledEC2API by the AWSCloud that owns it, so that every awstask
+// reconciling against the same cloud shares one pair of rate limiters.
+var throttledClients sync.Map // map[AWSCloud]*throttledEC2API
+
+// ThrottledEC2 returns a rate-limited, retrying ec2iface.EC2API for the given cloud,
+// constructing and caching one on first use. awstasks.Instance should call this instead of
+// cloud.EC2() directly.
+func ThrottledEC2(cloud AWSCloud) ec2iface.EC2API {
+	if existing, ok := throttledClients.Load(cloud); ok {
+		return existing.(*throttledEC2API)
+	}
+	wrapped := newThrottledEC2API(cloud.EC2())
+	actual, _ := throttledClients.LoadOrStore(cloud, wrapped)
+	return actual.(*throttledEC2API)
+}
+
+func (t *throttledEC2API) DescribeInstances(request *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	var response *ec2.DescribeInstancesOutput
+	err := t.withRetry(t.describeLimiter, func() error {
+		var err error
+		response, err = t.EC2API.DescribeInstances(request)
+		return err
+	})
+	return response, err
+}
+
+// DescribeInstancesPages is reimplemented, rather than inherited from the embedded client, so
+// that each underlying DescribeInstances call goes through the same rate limiter/backoff as a
+// direct DescribeInstances call (the waitForState poll loop in awstasks uses this method).
+func (t *throttledEC2API) DescribeInstancesPages(request *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	req := *request
+	for {
+		page, err := t.DescribeInstances(&req)
+		if err != nil {
+			return err
+		}
+
+		lastPage := page.NextToken == nil || *page.NextToken == ""
+		if !fn(page, lastPage) || lastPage {
+			return nil
+		}
+
+		req.NextToken = page.NextToken
+	}
+}
+
+func (t *throttledEC2API) DescribeInstanceAttribute(request *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error) {
+	var response *ec2.DescribeInstanceAttributeOutput
+	err := t.withRetry(t.describeLimiter, func() error {
+		var err error
+		response, err = t.EC2API.DescribeInstanceAttribute(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) DescribeVolumes(request *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	var response *ec2.DescribeVolumesOutput
+	err := t.withRetry(t.describeLimiter, func() error {
+		var err error
+		response, err = t.EC2API.DescribeVolumes(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) DescribeSpotInstanceRequests(request *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+	var response *ec2.DescribeSpotInstanceRequestsOutput
+	err := t.withRetry(t.describeLimiter, func() error {
+		var err error
+		response, err = t.EC2API.DescribeSpotInstanceRequests(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) DescribeIamInstanceProfileAssociations(request *ec2.DescribeIamInstanceProfileAssociationsInput) (*ec2.DescribeIamInstanceProfileAssociationsOutput, error) {
+	var response *ec2.DescribeIamInstanceProfileAssociationsOutput
+	err := t.withRetry(t.describeLimiter, func() error {
+		var err error
+		response, err = t.EC2API.DescribeIamInstanceProfileAssociations(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) RunInstances(request *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	var response *ec2.Reservation
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.RunInstances(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) CreateTags(request *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	var response *ec2.CreateTagsOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.CreateTags(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) DeleteTags(request *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	var response *ec2.DeleteTagsOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.DeleteTags(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) RequestSpotInstances(request *ec2.RequestSpotInstancesInput) (*ec2.RequestSpotInstancesOutput, error) {
+	var response *ec2.RequestSpotInstancesOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.RequestSpotInstances(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) CancelSpotInstanceRequests(request *ec2.CancelSpotInstanceRequestsInput) (*ec2.CancelSpotInstanceRequestsOutput, error) {
+	var response *ec2.CancelSpotInstanceRequestsOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.CancelSpotInstanceRequests(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) ModifyInstanceAttribute(request *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error) {
+	var response *ec2.ModifyInstanceAttributeOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.ModifyInstanceAttribute(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) ModifyInstanceMetadataOptions(request *ec2.ModifyInstanceMetadataOptionsInput) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+	var response *ec2.ModifyInstanceMetadataOptionsOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.ModifyInstanceMetadataOptions(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) StopInstances(request *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	var response *ec2.StopInstancesOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.StopInstances(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) StartInstances(request *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	var response *ec2.StartInstancesOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.StartInstances(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) AssociateIamInstanceProfile(request *ec2.AssociateIamInstanceProfileInput) (*ec2.AssociateIamInstanceProfileOutput, error) {
+	var response *ec2.AssociateIamInstanceProfileOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.AssociateIamInstanceProfile(request)
+		return err
+	})
+	return response, err
+}
+
+func (t *throttledEC2API) ReplaceIamInstanceProfileAssociation(request *ec2.ReplaceIamInstanceProfileAssociationInput) (*ec2.ReplaceIamInstanceProfileAssociationOutput, error) {
+	var response *ec2.ReplaceIamInstanceProfileAssociationOutput
+	err := t.withRetry(t.mutatingLimiter, func() error {
+		var err error
+		response, err = t.EC2API.ReplaceIamInstanceProfileAssociation(request)
+		return err
+	})
+	return response, err
+}
+
+// withRetry runs fn, waiting on limiter beforehand, and retries with exponential backoff and
+// jitter if fn fails with a throttling error.
+func (t *throttledEC2API) withRetry(limiter *rate.Limiter, fn func() error) error {
+	delay := throttleMinDelay
+
+	for attempt := 0; ; attempt++ {
+		// Best effort: the limiter only returns an error if the wait would exceed its burst,
+		// which never happens with context.Background(), so we ignore it and proceed.
+		_ = limiter.Wait(context.Background())
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if !isThrottleError(err) || attempt >= throttleMaxRetries {
+			return err
+		}
+
+		sleep := delay + time.Duration(rand.Int63n(int64(delay)))
+		glog.V(2).Infof("EC2 request throttled, backing off %v (attempt %d): %v", sleep, attempt+1, err)
+		time.Sleep(sleep)
+
+		delay *= 2
+		if delay > throttleMaxDelay {
+			delay = throttleMaxDelay
+		}
+	}
+}
+
+func isThrottleError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if throttleErrorCodes[awsErr.Code()] {
+			return true
+		}
+		return strings.Contains(awsErr.Message(), "Rate exceeded")
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"golang.org/x/time/rate"
+)
+
+// fakeEC2 embeds ec2iface.EC2API so it only needs to implement the methods a given test
+// actually exercises; any other method panics with a nil pointer dereference if called.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	describeInstancesCalls int
+}
+
+func (f *fakeEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.describeInstancesCalls++
+	return &ec2.DescribeInstancesOutput{}, nil
+}
+
+// TestDescribeInstancesNotCached guards against the regression where DescribeInstances was
+// cached by request content: waitForState's poll loop issues the same request on every
+// iteration and must see a fresh call each time, not a cached snapshot.
+func TestDescribeInstancesNotCached(t *testing.T) {
+	fake := &fakeEC2{}
+	wrapped := newThrottledEC2API(fake)
+
+	req := &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String("i-123")}}
+	if _, err := wrapped.DescribeInstances(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := wrapped.DescribeInstances(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fake.describeInstancesCalls != 2 {
+		t.Errorf("expected 2 calls to the underlying DescribeInstances, got %d (result is being cached)", fake.describeInstancesCalls)
+	}
+}
+
+func TestIsThrottleError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"RequestLimitExceeded", awserr.New("RequestLimitExceeded", "too many requests", nil), true},
+		{"Throttling", awserr.New("Throttling", "rate exceeded", nil), true},
+		{"ClientRequestLimitExceeded", awserr.New("Client.RequestLimitExceeded", "slow down", nil), true},
+		{"rate exceeded message on unrelated code", awserr.New("SomeOtherCode", "Rate exceeded", nil), true},
+		{"unrelated error", awserr.New("InvalidInstanceID.NotFound", "no such instance", nil), false},
+		{"non-awserr", fmt.Errorf("boom"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isThrottleError(c.err); got != c.want {
+				t.Errorf("isThrottleError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+// TestWithRetryBacksOffThenSucceeds verifies withRetry retries a throttled call instead of
+// propagating the error immediately, and returns once the call stops being throttled.
+func TestWithRetryBacksOffThenSucceeds(t *testing.T) {
+	wrapped := newThrottledEC2API(&fakeEC2{})
+	// Burst of 1 at an effectively infinite rate so the limiter itself doesn't slow the test down.
+	limiter := rate.NewLimiter(rate.Inf, 1)
+
+	attempts := 0
+	err := wrapped.withRetry(limiter, func() error {
+		attempts++
+		if attempts < 2 {
+			return awserr.New("RequestLimitExceeded", "too many requests", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected withRetry to eventually succeed, got: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts (1 throttled + 1 success), got %d", attempts)
+	}
+}
+
+// TestWithRetryGivesUpOnNonThrottleError verifies a non-throttling error is returned immediately,
+// without retrying.
+func TestWithRetryGivesUpOnNonThrottleError(t *testing.T) {
+	wrapped := newThrottledEC2API(&fakeEC2{})
+	limiter := rate.NewLimiter(rate.Inf, 1)
+
+	attempts := 0
+	err := wrapped.withRetry(limiter, func() error {
+		attempts++
+		return awserr.New("InvalidInstanceID.NotFound", "no such instance", nil)
+	})
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if attempts != 1 {
+		t.Errorf("expected exactly 1 attempt for a non-throttling error, got %d", attempts)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsup
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+// S3UserDataStore uploads oversized UserData payloads to a kops-managed S3 bucket (the
+// cluster's state store) and hands back a small bootstrap script that fetches and execs
+// the payload on boot. This lets us work around the 16KB EC2 UserData limit without
+// requiring users to stand up any extra infrastructure.
+type S3UserDataStore struct {
+	cloud  AWSCloud
+	bucket string
+	prefix string
+}
+
+// NewS3UserDataStore creates a S3UserDataStore that stores overflow UserData objects under
+// "<prefix>/userdata/" in the given bucket, reusing the cluster's existing state-store credentials.
+func NewS3UserDataStore(cloud AWSCloud, bucket string, prefix string) *S3UserDataStore {
+	return &S3UserDataStore{
+		cloud:  cloud,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+// Put uploads the UserData payload for the given instance/resource name, returning the S3 key it was stored under.
+func (s *S3UserDataStore) Put(name string, data []byte) (string, error) {
+	key := fmt.Sprintf("%s/userdata/%s.dat", strings.TrimSuffix(s.prefix, "/"), name)
+
+	glog.V(2).Infof("uploading overflow UserData to s3://%s/%s (%d bytes)", s.bucket, key, len(data))
+
+	s3Client, err := s.cloud.S3()
+	if err != nil {
+		return "", fmt.Errorf("error building S3 client: %v", err)
+	}
+
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error uploading overflow UserData to s3://%s/%s: %v", s.bucket, key, err)
+	}
+
+	return key, nil
+}
+
+// BootstrapScript returns a tiny UserData script that fetches the real UserData object from
+// S3 and execs it. It signs the GET itself with the instance's own IMDS credentials using
+// curl + openssl, deliberately avoiding a dependency on the AWS CLI being present in the image.
+func (s *S3UserDataStore) BootstrapScript(key string) string {
+	return fmt.Sprintf(`#!/bin/bash
+set -o errexit
+set -o nounset
+set -o pipefail
+
+# Fetch the overflow UserData object from S3 using a SigV4-signed GET, authenticated with this
+# instance's own instance-profile credentials. This intentionally doesn't shell out to the AWS
+# CLI, which isn't guaranteed to be present on the image.
+
+REGION=%s
+BUCKET=%s
+KEY=%s
+HOST="${BUCKET}.s3.${REGION}.amazonaws.com"
+
+TOKEN=$(curl -s -X PUT -H "X-aws-ec2-metadata-token-ttl-seconds: 60" http://169.254.169.254/latest/api/token)
+ROLE=$(curl -s -H "X-aws-ec2-metadata-token: ${TOKEN}" http://169.254.169.254/latest/meta-data/iam/security-credentials/)
+CREDS=$(curl -s -H "X-aws-ec2-metadata-token: ${TOKEN}" "http://169.254.169.254/latest/meta-data/iam/security-credentials/${ROLE}")
+AWS_ACCESS_KEY_ID=$(echo "${CREDS}" | sed -n 's/.*"AccessKeyId" *: *"\([^"]*\)".*/\1/p')
+AWS_SECRET_ACCESS_KEY=$(echo "${CREDS}" | sed -n 's/.*"SecretAccessKey" *: *"\([^"]*\)".*/\1/p')
+AWS_SESSION_TOKEN=$(echo "${CREDS}" | sed -n 's/.*"Token" *: *"\([^"]*\)".*/\1/p')
+
+DATE=$(date -u +%%Y%%m%%dT%%H%%M%%SZ)
+DATESTAMP=$(date -u +%%Y%%m%%d)
+EMPTY_PAYLOAD_HASH=$(printf '' | openssl dgst -sha256 | sed 's/^.* //')
+
+CANONICAL_REQUEST="GET
+/${KEY}
+
+host:${HOST}
+x-amz-content-sha256:${EMPTY_PAYLOAD_HASH}
+x-amz-date:${DATE}
+x-amz-security-token:${AWS_SESSION_TOKEN}
+
+host;x-amz-content-sha256;x-amz-date;x-amz-security-token
+${EMPTY_PAYLOAD_HASH}"
+
+SCOPE="${DATESTAMP}/${REGION}/s3/aws4_request"
+STRING_TO_SIGN="AWS4-HMAC-SHA256
+${DATE}
+${SCOPE}
+$(printf '%%s' "${CANONICAL_REQUEST}" | openssl dgst -sha256 | sed 's/^.* //')"
+
+hmac_sha256() { openssl dgst -sha256 -mac HMAC -macopt "hexkey:$1" | sed 's/^.* //'; }
+hmac_sha256_raw() { openssl dgst -sha256 -mac HMAC -macopt "hexkey:$1" -binary | xxd -p -c 256; }
+
+K_DATE=$(printf '%%s' "${DATESTAMP}" | openssl dgst -sha256 -mac HMAC -macopt "key:AWS4${AWS_SECRET_ACCESS_KEY}" -binary | xxd -p -c 256)
+K_REGION=$(printf '%%s' "${REGION}" | hmac_sha256_raw "${K_DATE}")
+K_SERVICE=$(printf '%%s' "s3" | hmac_sha256_raw "${K_REGION}")
+K_SIGNING=$(printf '%%s' "aws4_request" | hmac_sha256_raw "${K_SERVICE}")
+SIGNATURE=$(printf '%%s' "${STRING_TO_SIGN}" | hmac_sha256 "${K_SIGNING}")
+
+AUTH="AWS4-HMAC-SHA256 Credential=${AWS_ACCESS_KEY_ID}/${SCOPE}, SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature=${SIGNATURE}"
+
+mkdir -p /var/cache/kops
+curl -sf \
+  -H "x-amz-date: ${DATE}" \
+  -H "x-amz-content-sha256: ${EMPTY_PAYLOAD_HASH}" \
+  -H "x-amz-security-token: ${AWS_SESSION_TOKEN}" \
+  -H "Authorization: ${AUTH}" \
+  "https://${HOST}/${KEY}" -o /var/cache/kops/userdata.gz
+
+# Overflow UserData is gzip-compressed before it is handed to Put (Put itself uploads the bytes
+# as given), so it always needs decompressing here, not just "if it happens to look like gzip".
+gunzip -f /var/cache/kops/userdata.gz
+chmod +x /var/cache/kops/userdata
+exec /var/cache/kops/userdata
+`, s.cloud.Region(), s.bucket, key)
+}
+
+// GrantReadStatement returns the IAM policy statement an instance profile needs in order to
+// fetch the overflow UserData object this store uploaded under key. The caller (the
+// instance-profile/role policy builder) is responsible for merging this into the role's policy
+// document; this package only owns the S3 side of the object's lifecycle.
+func (s *S3UserDataStore) GrantReadStatement(key string) map[string]interface{} {
+	return map[string]interface{}{
+		"Effect":   "Allow",
+		"Action":   []string{"s3:GetObject"},
+		"Resource": fmt.Sprintf("arn:aws:s3:::%s/%s", s.bucket, key),
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsup
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeCloud embeds AWSCloud so it only needs to implement Region; any other method panics with
+// a nil pointer dereference if a test exercises it.
+type fakeCloud struct {
+	AWSCloud
+
+	region string
+}
+
+func (f *fakeCloud) Region() string {
+	return f.region
+}
+
+// TestBootstrapScriptCanonicalRequest guards the SigV4 canonical request format: GET requests
+// with no query string require a blank line for CanonicalQueryString between the URI and the
+// signed headers block. Omitting it (as originally shipped) makes S3 compute a different
+// canonical request server-side, so every signed GET fails with SignatureDoesNotMatch.
+func TestBootstrapScriptCanonicalRequest(t *testing.T) {
+	store := &S3UserDataStore{cloud: &fakeCloud{region: "us-west-2"}, bucket: "my-bucket", prefix: "instances"}
+	script := store.BootstrapScript("instances/userdata/node-1.dat.gz")
+
+	start := strings.Index(script, `CANONICAL_REQUEST="GET`)
+	end := strings.Index(script, `"`+"\n\nSCOPE=")
+	if start == -1 || end == -1 || end <= start {
+		t.Fatalf("could not locate CANONICAL_REQUEST block in generated script:\n%s", script)
+	}
+	block := script[start:end]
+
+	lines := strings.Split(block, "\n")
+	want := []string{
+		`CANONICAL_REQUEST="GET`,
+		`/${KEY}`,
+		``, // CanonicalQueryString is empty for this request
+		`host:${HOST}`,
+		`x-amz-content-sha256:${EMPTY_PAYLOAD_HASH}`,
+		`x-amz-date:${DATE}`,
+		`x-amz-security-token:${AWS_SESSION_TOKEN}`,
+		``,
+		`host;x-amz-content-sha256;x-amz-date;x-amz-security-token`,
+		`${EMPTY_PAYLOAD_HASH}`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("CANONICAL_REQUEST has %d lines, want %d:\n%s", len(lines), len(want), block)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("CANONICAL_REQUEST line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+// TestBootstrapScriptDecompressesBeforeExec guards against executing the fetched object without
+// decompressing it first: overflowUserDataToS3 in awstasks only ever spills UserData after it has
+// already been gzipped (RenderAWS gzips any UserData larger than MaxUserDataSize), so the
+// fetched object is always a gzip archive, never a raw script.
+func TestBootstrapScriptDecompressesBeforeExec(t *testing.T) {
+	store := &S3UserDataStore{cloud: &fakeCloud{region: "us-west-2"}, bucket: "my-bucket", prefix: "instances"}
+	script := store.BootstrapScript("instances/userdata/node-1.dat.gz")
+
+	fetchIdx := strings.Index(script, "-o /var/cache/kops/userdata.gz")
+	gunzipIdx := strings.Index(script, "gunzip -f /var/cache/kops/userdata.gz")
+	execIdx := strings.Index(script, "exec /var/cache/kops/userdata")
+
+	if fetchIdx == -1 || gunzipIdx == -1 || execIdx == -1 {
+		t.Fatalf("expected fetch, gunzip, and exec steps all present in script:\n%s", script)
+	}
+	if !(fetchIdx < gunzipIdx && gunzipIdx < execIdx) {
+		t.Errorf("expected fetch -> gunzip -> exec order, got offsets %d, %d, %d", fetchIdx, gunzipIdx, execIdx)
+	}
+}